@@ -11,20 +11,33 @@ import (
 	_ "stbridge/pidfdhack"
 
 	"archive/zip"
+	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 	_ "unsafe"
 
+	"golang.org/x/crypto/scrypt"
 	_ "golang.org/x/mobile/event/key"
 
 	_ "github.com/syncthing/syncthing/cmd/syncthing/cli"
@@ -33,6 +46,7 @@ import (
 	"github.com/syncthing/syncthing/lib/events"
 	"github.com/syncthing/syncthing/lib/fs"
 	"github.com/syncthing/syncthing/lib/locations"
+	"github.com/syncthing/syncthing/lib/protocol"
 	"github.com/syncthing/syncthing/lib/rand"
 	"github.com/syncthing/syncthing/lib/svcutil"
 	"github.com/syncthing/syncthing/lib/syncthing"
@@ -168,9 +182,82 @@ func SetLogLevel(level string) error {
 }
 
 type SyncthingApp struct {
-	app     *syncthing.App
-	cfg     config.Wrapper
-	guiCert *x509.Certificate
+	app      *syncthing.App
+	cfg      config.Wrapper
+	guiCert  *x509.Certificate
+	receiver SyncthingStatusReceiver
+	cancel   context.CancelFunc
+
+	evLogger events.Logger
+
+	streamsMu sync.Mutex
+	streams   map[*EventStream]struct{}
+
+	audit *auditSink
+}
+
+// currentApp is the app returned by the most recent successful Start that
+// hasn't yet fully stopped. It's guarded by stLock and lets operations like
+// ImportConfiguration and the config-mutation API tell whether Syncthing is
+// running without holding stLock for the app's entire lifetime.
+var currentApp *SyncthingApp
+
+// StartupError is returned by Start when Syncthing's GUI never came up
+// within the configured timeout, so the Android layer can show a specific
+// diagnostic instead of a generic "stopped" toast.
+type StartupError struct {
+	Err error
+}
+
+func (e *StartupError) Error() string {
+	return fmt.Sprintf("syncthing failed to start: %v", e.Err)
+}
+
+func (e *StartupError) Unwrap() error {
+	return e.Err
+}
+
+const defaultStartupTimeout = 30 * time.Second
+
+// waitForGUI polls the GUI's TLS listener until it accepts a connection
+// presenting guiCert, or timeout elapses. The generated GUI cert isn't
+// guaranteed to carry its CN as a SAN entry, so hostname verification is
+// skipped in favor of pinning the exact leaf certificate we expect.
+func waitForGUI(cfg config.Wrapper, guiCert *x509.Certificate, timeout time.Duration) error {
+	addr := cfg.GUI().URL()
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return fmt.Errorf("failed to parse GUI address: %q: %w", addr, err)
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) > 0 && bytes.Equal(rawCerts[0], guiCert.Raw) {
+				return nil
+			}
+
+			return fmt.Errorf("presented certificate does not match the expected GUI certificate")
+		},
+	}
+	dialer := &net.Dialer{Timeout: 500 * time.Millisecond}
+
+	deadline := time.Now().Add(timeout)
+
+	var lastErr error
+	for time.Now().Before(deadline) {
+		conn, err := tls.DialWithDialer(dialer, "tcp", u.Host, tlsConfig)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+
+		lastErr = err
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	return fmt.Errorf("gui did not become reachable within %s: %w", timeout, lastErr)
 }
 
 func (app *SyncthingApp) StopAsync() {
@@ -193,305 +280,1527 @@ func (app *SyncthingApp) GuiTlsCert() []byte {
 	return app.guiCert.Raw
 }
 
-type SyncthingStatusReceiver interface {
-	OnSyncthingStart(app *SyncthingApp)
-
-	OnSyncthingStop(app *SyncthingApp)
-}
-
-type SyncthingStartupConfig struct {
-	FilesDir    string
-	DeviceModel string
-	Proxy       string
-	NoProxy     string
-	Receiver    SyncthingStatusReceiver
+// eventTypesByName maps the event names used by the Syncthing REST API and
+// documentation to their bitmask values, so callers can request a mask as a
+// plain comma-separated string instead of needing the numeric bitmask.
+var eventTypesByName = map[string]events.EventType{
+	"Starting":                events.Starting,
+	"StartupComplete":         events.StartupComplete,
+	"DeviceDiscovered":        events.DeviceDiscovered,
+	"DeviceConnected":         events.DeviceConnected,
+	"DeviceDisconnected":      events.DeviceDisconnected,
+	"DeviceRejected":          events.DeviceRejected,
+	"DevicePaused":            events.DevicePaused,
+	"DeviceResumed":           events.DeviceResumed,
+	"ClusterConfigReceived":   events.ClusterConfigReceived,
+	"LocalIndexUpdated":       events.LocalIndexUpdated,
+	"RemoteIndexUpdated":      events.RemoteIndexUpdated,
+	"ItemStarted":             events.ItemStarted,
+	"ItemFinished":            events.ItemFinished,
+	"StateChanged":            events.StateChanged,
+	"LocalChangeDetected":     events.LocalChangeDetected,
+	"RemoteChangeDetected":    events.RemoteChangeDetected,
+	"FolderCompletion":        events.FolderCompletion,
+	"FolderSummary":           events.FolderSummary,
+	"FolderErrors":            events.FolderErrors,
+	"FolderScanProgress":      events.FolderScanProgress,
+	"FolderPaused":            events.FolderPaused,
+	"FolderResumed":           events.FolderResumed,
+	"FolderWatchStateChanged": events.FolderWatchStateChanged,
+	"ListenAddressesChanged":  events.ListenAddressesChanged,
+	"ConfigSaved":             events.ConfigSaved,
+	"DownloadProgress":        events.DownloadProgress,
+	"RemoteDownloadProgress":  events.RemoteDownloadProgress,
+	"Failure":                 events.Failure,
+	"LoginAttempt":            events.LoginAttempt,
+	"PendingDevicesChanged":   events.PendingDevicesChanged,
+	"PendingFoldersChanged":   events.PendingFoldersChanged,
 }
 
-func Run(startup *SyncthingStartupConfig) error {
-	stLock.Lock()
-	defer stLock.Unlock()
-
-	configDir := filepath.Join(startup.FilesDir, "syncthing")
-	if err := locations.SetBaseDir(locations.ConfigBaseDir, configDir); err != nil {
-		return fmt.Errorf("failed to set config directory: %w", err)
-	} else if err := locations.SetBaseDir(locations.DataBaseDir, configDir); err != nil {
-		return fmt.Errorf("failed to set data directory: %w", err)
-	}
-	log.Print(locations.PrettyPaths())
+func parseEventMask(mask string) (events.EventType, error) {
+	var result events.EventType
 
-	applyProxySettings(startup.Proxy, startup.NoProxy)
+	for _, name := range strings.Split(mask, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
 
-	for _, dir := range []locations.BaseDirEnum{locations.ConfigBaseDir, locations.DataBaseDir} {
-		if err := syncthing.EnsureDir(locations.GetBaseDir(dir), 0o700); err != nil {
-			return fmt.Errorf("failed to create directory: %q: %v", dir, err)
+		typ, ok := eventTypesByName[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown event type: %q", name)
 		}
+
+		result |= typ
 	}
 
-	cert, err := syncthing.LoadOrGenerateCertificate(
-		locations.Get(locations.CertFile),
-		locations.Get(locations.KeyFile),
-	)
-	if err != nil {
-		return fmt.Errorf("failed to load or generate certificate: %w", err)
+	if result == 0 {
+		return 0, fmt.Errorf("event mask matched no known event types: %q", mask)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	return result, nil
+}
 
-	evLogger := events.NewLogger()
-	go evLogger.Serve(ctx)
+// EventStream is a live handle to a subset of the Syncthing event bus. It is
+// deliberately free of channels and interface slices so that it binds
+// cleanly to gomobile; callers drain it by polling NextBatchJSON.
+type EventStream struct {
+	app *SyncthingApp
 
-	cfg, err := syncthing.LoadConfigAtStartup(locations.Get(locations.ConfigFile), cert, evLogger, false, true)
-	if err != nil {
-		return fmt.Errorf("failed to load config: %w", err)
+	mu      sync.Mutex
+	buf     []events.Event
+	cap     int
+	dropped uint64
+	notify  chan struct{}
+	closed  bool
+
+	cancel context.CancelFunc
+}
+
+func newEventStream(app *SyncthingApp, bufferSize int) *EventStream {
+	return &EventStream{
+		app:    app,
+		cap:    bufferSize,
+		notify: make(chan struct{}),
 	}
-	go cfg.Serve(ctx)
+}
 
-	waiter, err := cfg.Modify(func(c *config.Configuration) {
-		// Try to stick with existing ports, but always allow picking new ones
-		// so that running multiple instances of the app (eg. for debugging) is
-		// possible.
-		if err = c.ProbeFreePorts(); err != nil {
-			log.Printf("Failed to probe free ports")
-		}
+// push appends ev to the ring buffer, dropping the oldest buffered event if
+// it is full. This is what keeps a stalled JVM consumer from ever blocking
+// the shared event bus.
+func (es *EventStream) push(ev events.Event) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
 
-		// Try to prevent users from locking themselves out.
-		c.GUI.Enabled = true
+	if es.closed {
+		return
+	}
 
-		// Just use HTTPS instead of forcing Android to permit HTTP connections.
-		c.GUI.RawUseTLS = true
+	if len(es.buf) >= es.cap {
+		es.buf = append(es.buf[:0], es.buf[1:]...)
+		es.dropped++
+	}
+	es.buf = append(es.buf, ev)
 
-		// Prevent insecure authentication.
-		if len(c.GUI.User) == 0 {
-			log.Printf("Setting username to random string")
-			c.GUI.User = rand.String(32)
+	close(es.notify)
+	es.notify = make(chan struct{})
+}
+
+// NextBatch blocks until at least one event is available or ctx is done,
+// then returns and clears everything currently buffered.
+func (es *EventStream) NextBatch(ctx context.Context) ([]events.Event, error) {
+	for {
+		es.mu.Lock()
+		if len(es.buf) > 0 {
+			batch := es.buf
+			es.buf = nil
+			es.mu.Unlock()
+			return batch, nil
 		}
-		if len(c.GUI.APIKey) == 0 {
-			log.Printf("Setting API key to random string")
-			c.GUI.APIKey = rand.String(32)
+		if es.closed {
+			es.mu.Unlock()
+			return nil, fmt.Errorf("event stream is closed")
 		}
+		wait := es.notify
+		es.mu.Unlock()
 
-		// There is no good way to set "X-Api-Key" nor "Authorization: Bearer"
-		// in Android's WebView. The only way to pass in additional headers is
-		// when calling the initial loadUrl() and basic authentication is the
-		// only method that'll persist in the session. We'll force the password
-		// to be the API key so that we always know its value.
-		if c.GUI.CompareHashedPassword(c.GUI.APIKey) != nil {
-			log.Printf("Setting password to API key")
-			c.GUI.SetPassword(c.GUI.APIKey)
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
+	}
+}
 
-		// This can't work on Android.
-		c.Options.StartBrowser = false
+// NextBatchJSON is the gomobile-facing counterpart to NextBatch: it waits up
+// to timeoutMs for the next batch and returns it JSON-encoded.
+func (es *EventStream) NextBatchJSON(timeoutMs int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMs)*time.Millisecond)
+	defer cancel()
 
-		// Disable crash reports since they are not debuggable by upstream.
-		c.Options.CREnabled = false
+	batch, err := es.NextBatch(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-		// /sdcard does not support permissions.
-		c.Defaults.Folder.IgnorePerms = true
-		// Reduce CPU usage due to file hashing.
-		c.Defaults.Folder.Hashers = 1
+	return json.Marshal(batch)
+}
 
-		for _, folder := range c.Folders {
-			folder.IgnorePerms = true
-			folder.Hashers = 1
+// Dropped returns the number of events that were discarded because this
+// stream's buffer was full.
+func (es *EventStream) Dropped() int64 {
+	es.mu.Lock()
+	defer es.mu.Unlock()
 
-			c.SetFolder(folder)
-		}
+	return int64(es.dropped)
+}
 
-		// Set device name to model name.
-		device, _, _ := c.Device(cfg.MyID())
-		hostname, _ := os.Hostname()
-		if device.Name == hostname {
-			device.Name = startup.DeviceModel
+func (es *EventStream) Close() {
+	es.mu.Lock()
+	if es.closed {
+		es.mu.Unlock()
+		return
+	}
+	es.closed = true
+	close(es.notify)
+	es.mu.Unlock()
 
-			c.SetDevice(device)
-		}
-	})
-	if err != nil {
-		return fmt.Errorf("failed to override config options: %w", err)
+	es.cancel()
+
+	if es.app != nil {
+		es.app.removeStream(es)
 	}
-	waiter.Wait()
+}
 
-	err = cfg.Save()
+func (app *SyncthingApp) removeStream(es *EventStream) {
+	app.streamsMu.Lock()
+	delete(app.streams, es)
+	app.streamsMu.Unlock()
+}
+
+// Subscribe starts draining the event bus for the event types named in mask
+// (a comma-separated list, e.g. "FolderSummary,DeviceConnected") into a new
+// EventStream with the given buffer size. Multiple concurrent streams are
+// supported; all are torn down when the app stops.
+func (app *SyncthingApp) Subscribe(mask string, bufferSize int) (*EventStream, error) {
+	typ, err := parseEventMask(mask)
 	if err != nil {
-		return fmt.Errorf("failed to save overridden config: %w", err)
+		return nil, err
 	}
 
-	dbDeleteRetentionInterval := time.Duration(10920) * time.Hour
-	if err := syncthing.TryMigrateDatabase(ctx, dbDeleteRetentionInterval); err != nil {
-		return fmt.Errorf("failed to migrate old database: %w", err)
+	if bufferSize <= 0 {
+		bufferSize = 64
 	}
 
-	sdb, err := syncthing.OpenDatabase(locations.Get(locations.Database), dbDeleteRetentionInterval)
+	var stream *EventStream
+	err = app.withRunningApp(func() error {
+		sub := app.evLogger.Subscribe(typ)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		stream = newEventStream(app, bufferSize)
+		stream.cancel = cancel
+
+		app.streamsMu.Lock()
+		app.streams[stream] = struct{}{}
+		app.streamsMu.Unlock()
+
+		go func() {
+			defer sub.Unsubscribe()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case ev, ok := <-sub.C():
+					if !ok {
+						return
+					}
+					stream.push(ev)
+				}
+			}
+		}()
+
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to open database: %w", err)
+		return nil, err
 	}
 
-	cleanOldFiles()
+	return stream, nil
+}
 
-	appOpts := syncthing.Options{
-		NoUpgrade:             true,
-		ProfilerAddr:          "",
-		ResetDeltaIdxs:        false,
-		DBMaintenanceInterval: time.Duration(8) * time.Hour,
+// PostEvent injects an event onto the same bus that Subscribe drains, so
+// UI-originating actions (e.g. a user-triggered rescan) show up alongside
+// events generated by Syncthing itself.
+func (app *SyncthingApp) PostEvent(name string, dataJSON []byte) error {
+	typ, ok := eventTypesByName[name]
+	if !ok {
+		return fmt.Errorf("unknown event type: %q", name)
 	}
 
-	app, err := syncthing.New(cfg, sdb, evLogger, cert, appOpts)
-	if err != nil {
-		return fmt.Errorf("failed to initialize syncthing: %w", err)
+	var data any
+	if len(dataJSON) > 0 {
+		if err := json.Unmarshal(dataJSON, &data); err != nil {
+			return fmt.Errorf("failed to decode event data: %w", err)
+		}
 	}
 
-	if err := app.Start(); err != nil {
-		return fmt.Errorf("failed to start syncthing: %w", app.Error())
-	}
+	return app.withRunningApp(func() error {
+		app.evLogger.Log(typ, data)
 
-	// The GUI TLS certificate generation process is synchronous, so it's
-	// guaranteed to exist now.
-	guiCert, err := readPemCert(locations.Get(locations.HTTPSCertFile))
-	if err != nil {
-		return fmt.Errorf("failed to load GUI TLS certificate: %w", err)
-	}
+		return nil
+	})
+}
 
-	appWrapper := &SyncthingApp{
-		app:     app,
-		cfg:     cfg,
-		guiCert: guiCert,
+// closeAllStreams tears down every live EventStream. It is called once the
+// app has stopped so that no pump goroutines outlive it.
+func (app *SyncthingApp) closeAllStreams() {
+	app.streamsMu.Lock()
+	streams := make([]*EventStream, 0, len(app.streams))
+	for es := range app.streams {
+		streams = append(streams, es)
 	}
+	app.streamsMu.Unlock()
 
-	startup.Receiver.OnSyncthingStart(appWrapper)
+	for _, es := range streams {
+		es.Close()
+	}
+}
 
-	status := app.Wait()
+// applyAndroidInvariants enforces the Android-specific settings that the
+// rest of this package assumes always hold. It's applied both at startup
+// (see Start) and by every config-mutation method below, so a user-supplied
+// folder or device edit can never accidentally re-enable permissions bits
+// or spin up extra hashers.
+func applyAndroidInvariants(c *config.Configuration) {
+	// Just use HTTPS instead of forcing Android to permit HTTP connections.
+	c.GUI.RawUseTLS = true
+
+	// /sdcard does not support permissions.
+	c.Defaults.Folder.IgnorePerms = true
+	// Reduce CPU usage due to file hashing.
+	c.Defaults.Folder.Hashers = 1
+
+	for _, folder := range c.Folders {
+		folder.IgnorePerms = true
+		folder.Hashers = 1
+
+		c.SetFolder(folder)
+	}
+}
 
-	startup.Receiver.OnSyncthingStop(appWrapper)
+// ConfigError is returned by the config-mutation API below instead of a
+// plain error so the JVM layer can pull out which field failed validation
+// instead of just showing the message as-is.
+type ConfigError struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
 
-	if status == svcutil.ExitError {
-		return fmt.Errorf("failed when stopping syncthing: %w", app.Error())
+func (e *ConfigError) Error() string {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return e.Message
 	}
 
-	return nil
+	return string(data)
 }
 
-func ImportConfiguration(fd int, name string) error {
+func newConfigError(field, format string, args ...any) *ConfigError {
+	return &ConfigError{Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// withRunningApp runs fn only if app is still the currently-running
+// SyncthingApp, guarding against a stale reference used after the app has
+// stopped.
+func (app *SyncthingApp) withRunningApp(fn func() error) error {
 	stLock.Lock()
 	defer stLock.Unlock()
 
-	file := os.NewFile(uintptr(fd), name)
-	if file == nil {
-		return fmt.Errorf("failed to open fd: %d", fd)
+	if currentApp != app {
+		return newConfigError("", "syncthing is not running")
 	}
-	defer file.Close()
 
-	fileSize, err := file.Seek(0, io.SeekEnd)
-	if err != nil {
-		return fmt.Errorf("failed to determine file size: %d: %w", fd, err)
-	}
+	return fn()
+}
+
+// modifyConfig applies fn to the live configuration, re-enforces the
+// Android invariants, waits for the change to take effect and persists it.
+func (app *SyncthingApp) modifyConfig(fn func(*config.Configuration) error) error {
+	var fnErr error
+
+	waiter, err := app.cfg.Modify(func(c *config.Configuration) {
+		if fnErr = fn(c); fnErr != nil {
+			return
+		}
 
-	reader, err := zip.NewReader(file, fileSize)
+		applyAndroidInvariants(c)
+	})
 	if err != nil {
-		return err
+		return newConfigError("", "failed to modify config: %v", err)
 	}
+	waiter.Wait()
 
-	configDir := filepath.Clean(locations.GetBaseDir(locations.ConfigBaseDir))
+	if fnErr != nil {
+		return fnErr
+	}
 
-	if err := os.RemoveAll(configDir); err != nil {
-		return fmt.Errorf("failed to delete: %q: %w", configDir, err)
+	if err := app.cfg.Save(); err != nil {
+		return newConfigError("", "failed to save config: %v", err)
 	}
 
-	extractEntry := func(f *zip.File) error {
-		entry, err := f.Open()
-		if err != nil {
-			return fmt.Errorf("failed to open file entry: %q: %w", f.Name, err)
-		}
-		defer entry.Close()
+	return nil
+}
 
-		if f.FileInfo().IsDir() {
+// AddFolder adds or replaces (by ID) the folder described by folderJSON, a
+// JSON-encoded config.FolderConfiguration.
+func (app *SyncthingApp) AddFolder(folderJSON []byte) error {
+	var folder config.FolderConfiguration
+	if err := json.Unmarshal(folderJSON, &folder); err != nil {
+		return newConfigError("folder", "invalid folder: %v", err)
+	}
+
+	return app.withRunningApp(func() error {
+		return app.modifyConfig(func(c *config.Configuration) error {
+			c.SetFolder(folder)
 			return nil
-		}
+		})
+	})
+}
 
-		// Join() normalizes the path too.
-		path := filepath.Join(configDir, f.Name)
-		if !strings.HasPrefix(path, configDir+string(os.PathSeparator)) {
-			return fmt.Errorf("unsafe entry path: %q", f.Name)
-		}
+// RemoveFolder removes the folder with the given ID, if any.
+func (app *SyncthingApp) RemoveFolder(id string) error {
+	return app.withRunningApp(func() error {
+		return app.modifyConfig(func(c *config.Configuration) error {
+			c.Folders = slices.DeleteFunc(c.Folders, func(f config.FolderConfiguration) bool {
+				return f.ID == id
+			})
 
-		parent := filepath.Dir(path)
-		if err = os.MkdirAll(parent, 0o700); err != nil {
-			return fmt.Errorf("failed to create directory: %q: %w", parent, err)
-		}
+			return nil
+		})
+	})
+}
 
-		output, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode()&0o700)
-		if err != nil {
-			return fmt.Errorf("failed to open for writing: %q: %w", path, err)
-		}
-		defer output.Close()
+// SetFolderPaused pauses or resumes the folder with the given ID.
+func (app *SyncthingApp) SetFolderPaused(id string, paused bool) error {
+	return app.withRunningApp(func() error {
+		return app.modifyConfig(func(c *config.Configuration) error {
+			folder, ok := c.Folder(id)
+			if !ok {
+				return newConfigError("id", "unknown folder: %q", id)
+			}
 
-		if _, err = io.Copy(output, entry); err != nil {
-			return fmt.Errorf("failed to write file data: %q: %w", path, err)
-		}
+			folder.Paused = paused
+			c.SetFolder(folder)
 
-		return nil
-	}
+			return nil
+		})
+	})
+}
 
-	for _, f := range reader.File {
-		if err := extractEntry(f); err != nil {
-			return err
-		}
+// AddDevice adds or replaces (by device ID) the device described by
+// deviceJSON, a JSON-encoded config.DeviceConfiguration.
+func (app *SyncthingApp) AddDevice(deviceJSON []byte) error {
+	var device config.DeviceConfiguration
+	if err := json.Unmarshal(deviceJSON, &device); err != nil {
+		return newConfigError("device", "invalid device: %v", err)
 	}
 
-	return nil
+	return app.withRunningApp(func() error {
+		return app.modifyConfig(func(c *config.Configuration) error {
+			c.SetDevice(device)
+			return nil
+		})
+	})
 }
 
-func ExportConfiguration(fd int, name string) error {
-	stLock.Lock()
-	defer stLock.Unlock()
-
-	file := os.NewFile(uintptr(fd), name)
-	if file == nil {
-		return fmt.Errorf("failed to open fd: %d", fd)
+// RemoveDevice removes the device with the given ID, if any, from both the
+// device list and any folder shares.
+func (app *SyncthingApp) RemoveDevice(id string) error {
+	deviceID, err := protocol.DeviceIDFromString(id)
+	if err != nil {
+		return newConfigError("id", "invalid device id: %v", err)
 	}
-	defer file.Close()
 
-	writer := zip.NewWriter(file)
-	defer writer.Close()
+	return app.withRunningApp(func() error {
+		return app.modifyConfig(func(c *config.Configuration) error {
+			c.Devices = slices.DeleteFunc(c.Devices, func(d config.DeviceConfiguration) bool {
+				return d.DeviceID == deviceID
+			})
 
-	configDir := locations.GetBaseDir(locations.ConfigBaseDir)
+			for _, folder := range c.Folders {
+				folder.Devices = slices.DeleteFunc(folder.Devices, func(d config.FolderDeviceConfiguration) bool {
+					return d.DeviceID == deviceID
+				})
 
-	walker := func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return fmt.Errorf("failed when walking: %q: %w", configDir, err)
-		}
+				c.SetFolder(folder)
+			}
 
-		if !info.Mode().IsRegular() {
 			return nil
-		}
+		})
+	})
+}
 
-		relPath, err := filepath.Rel(configDir, path)
-		if err != nil {
-			return fmt.Errorf("failed to compute relative path: %q: %w", path, err)
-		}
+// PendingDevices returns the JSON-encoded set of devices that have
+// connected but aren't yet configured.
+func (app *SyncthingApp) PendingDevices() ([]byte, error) {
+	var result []byte
 
-		input, err := os.Open(path)
+	err := app.withRunningApp(func() error {
+		pending, err := app.app.Model().PendingDevices()
 		if err != nil {
-			return fmt.Errorf("failed to open for reading: %q: %w", path, err)
+			return newConfigError("", "failed to list pending devices: %v", err)
 		}
-		defer input.Close()
 
-		entry, err := writer.Create(relPath)
+		data, err := json.Marshal(pending)
 		if err != nil {
-			return fmt.Errorf("failed to create file entry: %q: %w", relPath, err)
+			return newConfigError("", "failed to encode pending devices: %v", err)
 		}
 
-		if _, err = io.Copy(entry, input); err != nil {
-			return fmt.Errorf("failed to write file data: %q: %w", relPath, err)
-		}
+		result = data
 
 		return nil
-	}
+	})
 
-	if err := filepath.Walk(configDir, walker); err != nil {
-		return fmt.Errorf("failed to walk: %q: %w", configDir, err)
+	return result, err
+}
+
+// AcceptPendingDevice configures the pending device with the given ID under
+// name and, if folderID is non-empty, shares that folder with it.
+func (app *SyncthingApp) AcceptPendingDevice(id, name, folderID string) error {
+	deviceID, err := protocol.DeviceIDFromString(id)
+	if err != nil {
+		return newConfigError("id", "invalid device id: %v", err)
 	}
 
-	return nil
+	return app.withRunningApp(func() error {
+		err := app.modifyConfig(func(c *config.Configuration) error {
+			var folder config.FolderConfiguration
+			if len(folderID) > 0 {
+				var ok bool
+				folder, ok = c.Folder(folderID)
+				if !ok {
+					return newConfigError("folderID", "unknown folder: %q", folderID)
+				}
+			}
+
+			device, _, ok := c.Device(deviceID)
+			if !ok {
+				device = config.NewDeviceConfiguration(deviceID, name)
+			}
+			c.SetDevice(device)
+
+			if len(folderID) > 0 {
+				folder.Devices = append(folder.Devices, config.FolderDeviceConfiguration{DeviceID: deviceID})
+				c.SetFolder(folder)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		app.app.Model().DismissPendingDevice(deviceID)
+
+		return nil
+	})
+}
+
+// auditSink streams a masked subset of the event bus to a caller-provided
+// fd as newline-delimited JSON, modeled on Syncthing's own auditService.
+type auditSink struct {
+	sub    events.Subscription
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	maxBytes int64
+}
+
+// closeAuditFile flushes file to stable storage before closing it, so
+// that stopping or rotating the audit log never drops events the OS has
+// buffered but not yet made durable.
+func closeAuditFile(file *os.File, receiver SyncthingStatusReceiver) {
+	if err := file.Sync(); err != nil {
+		receiver.OnAuditError(fmt.Sprintf("failed to flush audit log: %v", err))
+	}
+	file.Close()
+}
+
+func (a *auditSink) serve(ctx context.Context, file *os.File, receiver SyncthingStatusReceiver) {
+	defer close(a.done)
+	defer a.sub.Unsubscribe()
+
+	enc := json.NewEncoder(file)
+	var written int64
+
+	for {
+		select {
+		case <-ctx.Done():
+			closeAuditFile(file, receiver)
+			return
+		case ev, ok := <-a.sub.C():
+			if !ok {
+				closeAuditFile(file, receiver)
+				return
+			}
+
+			if err := enc.Encode(ev); err != nil {
+				receiver.OnAuditError(fmt.Sprintf("failed to write audit event: %v", err))
+				continue
+			}
+			if err := file.Sync(); err != nil {
+				receiver.OnAuditError(fmt.Sprintf("failed to flush audit log: %v", err))
+			}
+
+			if info, err := file.Stat(); err == nil {
+				written = info.Size()
+			}
+
+			if a.maxBytes > 0 && written >= a.maxBytes {
+				closeAuditFile(file, receiver)
+
+				fd := receiver.OnAuditRotate()
+				if fd < 0 {
+					return
+				}
+
+				file = os.NewFile(uintptr(fd), "audit")
+				enc = json.NewEncoder(file)
+				written = 0
+			}
+		}
+	}
+}
+
+// StartAudit begins streaming events matching mask to fd as one JSON object
+// per line, so power users get a persistent, tail-able audit trail without
+// long-polling the REST API from a foreground service. When maxBytes is
+// positive, the sink asks the receiver for a fresh fd via OnAuditRotate
+// once the current one has reached that size.
+func (app *SyncthingApp) StartAudit(fd int, mask string, maxBytes int64) error {
+	typ, err := parseEventMask(mask)
+	if err != nil {
+		return err
+	}
+
+	return app.withRunningApp(func() error {
+		if app.audit != nil {
+			return newConfigError("", "audit logging is already running")
+		}
+
+		file := os.NewFile(uintptr(fd), "audit")
+		if file == nil {
+			return newConfigError("fd", "failed to open fd: %d", fd)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		a := &auditSink{
+			sub:      app.evLogger.Subscribe(typ),
+			cancel:   cancel,
+			done:     make(chan struct{}),
+			maxBytes: maxBytes,
+		}
+
+		app.audit = a
+
+		go a.serve(ctx, file, app.receiver)
+
+		return nil
+	})
+}
+
+// StopAudit stops a running audit log sink started by StartAudit. It is a
+// no-op if no sink is running.
+func (app *SyncthingApp) StopAudit() error {
+	return app.withRunningApp(func() error {
+		if app.audit == nil {
+			return nil
+		}
+
+		app.audit.cancel()
+		<-app.audit.done
+		app.audit = nil
+
+		return nil
+	})
+}
+
+type SyncthingStatusReceiver interface {
+	OnSyncthingStart(app *SyncthingApp)
+
+	OnSyncthingStop(app *SyncthingApp)
+
+	// OnAuditError is called when the audit log sink started by StartAudit
+	// fails to encode or write an event. Audit logging keeps running after
+	// this is called; StopAudit must be called explicitly to stop it.
+	OnAuditError(err string)
+
+	// OnAuditRotate is called when the audit log sink's fd has reached the
+	// maxBytes passed to StartAudit. It must return a freshly opened fd
+	// backed by the caller's rotating-file helper, or a negative value to
+	// stop audit logging instead.
+	OnAuditRotate() int
+}
+
+type SyncthingStartupConfig struct {
+	FilesDir    string
+	DeviceModel string
+	Proxy       string
+	NoProxy     string
+	Receiver    SyncthingStatusReceiver
+
+	// StartupTimeoutMs bounds how long Start waits for the GUI listener to
+	// come up before giving up with a *StartupError. Zero means use
+	// defaultStartupTimeout.
+	StartupTimeoutMs int
+}
+
+// Run is a thin wrapper around Start and Wait for callers that don't need to
+// distinguish a startup failure from a post-startup stop.
+func Run(startup *SyncthingStartupConfig) error {
+	app, err := Start(startup)
+	if err != nil {
+		return err
+	}
+
+	return app.Wait()
+}
+
+// Start brings Syncthing up and returns once its GUI listener is bound (or
+// returns a *StartupError if it never comes up within StartupTimeoutMs).
+// Callers must eventually call Wait on the returned app to observe the
+// shutdown status; until Wait returns, the app stays registered as running
+// and further calls to Start fail.
+func Start(startup *SyncthingStartupConfig) (*SyncthingApp, error) {
+	stLock.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			stLock.Unlock()
+		}
+	}()
+
+	if currentApp != nil {
+		return nil, fmt.Errorf("syncthing is already running")
+	}
+
+	configDir := filepath.Join(startup.FilesDir, "syncthing")
+	if err := locations.SetBaseDir(locations.ConfigBaseDir, configDir); err != nil {
+		return nil, fmt.Errorf("failed to set config directory: %w", err)
+	} else if err := locations.SetBaseDir(locations.DataBaseDir, configDir); err != nil {
+		return nil, fmt.Errorf("failed to set data directory: %w", err)
+	}
+	log.Print(locations.PrettyPaths())
+
+	applyProxySettings(startup.Proxy, startup.NoProxy)
+
+	for _, dir := range []locations.BaseDirEnum{locations.ConfigBaseDir, locations.DataBaseDir} {
+		if err := syncthing.EnsureDir(locations.GetBaseDir(dir), 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create directory: %q: %v", dir, err)
+		}
+	}
+
+	cert, err := syncthing.LoadOrGenerateCertificate(
+		locations.Get(locations.CertFile),
+		locations.Get(locations.KeyFile),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load or generate certificate: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	evLogger := events.NewLogger()
+	go evLogger.Serve(ctx)
+
+	cfg, err := syncthing.LoadConfigAtStartup(locations.Get(locations.ConfigFile), cert, evLogger, false, true)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	go cfg.Serve(ctx)
+
+	waiter, err := cfg.Modify(func(c *config.Configuration) {
+		// Try to stick with existing ports, but always allow picking new ones
+		// so that running multiple instances of the app (eg. for debugging) is
+		// possible.
+		if err = c.ProbeFreePorts(); err != nil {
+			log.Printf("Failed to probe free ports")
+		}
+
+		// Try to prevent users from locking themselves out.
+		c.GUI.Enabled = true
+
+		// Prevent insecure authentication.
+		if len(c.GUI.User) == 0 {
+			log.Printf("Setting username to random string")
+			c.GUI.User = rand.String(32)
+		}
+		if len(c.GUI.APIKey) == 0 {
+			log.Printf("Setting API key to random string")
+			c.GUI.APIKey = rand.String(32)
+		}
+
+		// There is no good way to set "X-Api-Key" nor "Authorization: Bearer"
+		// in Android's WebView. The only way to pass in additional headers is
+		// when calling the initial loadUrl() and basic authentication is the
+		// only method that'll persist in the session. We'll force the password
+		// to be the API key so that we always know its value.
+		if c.GUI.CompareHashedPassword(c.GUI.APIKey) != nil {
+			log.Printf("Setting password to API key")
+			c.GUI.SetPassword(c.GUI.APIKey)
+		}
+
+		// This can't work on Android.
+		c.Options.StartBrowser = false
+
+		// Disable crash reports since they are not debuggable by upstream.
+		c.Options.CREnabled = false
+
+		applyAndroidInvariants(c)
+
+		// Set device name to model name.
+		device, _, _ := c.Device(cfg.MyID())
+		hostname, _ := os.Hostname()
+		if device.Name == hostname {
+			device.Name = startup.DeviceModel
+
+			c.SetDevice(device)
+		}
+	})
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to override config options: %w", err)
+	}
+	waiter.Wait()
+
+	err = cfg.Save()
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to save overridden config: %w", err)
+	}
+
+	dbDeleteRetentionInterval := time.Duration(10920) * time.Hour
+	if err := syncthing.TryMigrateDatabase(ctx, dbDeleteRetentionInterval); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to migrate old database: %w", err)
+	}
+
+	sdb, err := syncthing.OpenDatabase(locations.Get(locations.Database), dbDeleteRetentionInterval)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	cleanOldFiles()
+
+	appOpts := syncthing.Options{
+		NoUpgrade:             true,
+		ProfilerAddr:          "",
+		ResetDeltaIdxs:        false,
+		DBMaintenanceInterval: time.Duration(8) * time.Hour,
+	}
+
+	app, err := syncthing.New(cfg, sdb, evLogger, cert, appOpts)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to initialize syncthing: %w", err)
+	}
+
+	if err := app.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to start syncthing: %w", app.Error())
+	}
+
+	// The GUI TLS certificate generation process is synchronous, so it's
+	// guaranteed to exist now.
+	guiCert, err := readPemCert(locations.Get(locations.HTTPSCertFile))
+	if err != nil {
+		cancel()
+		go app.Stop(svcutil.ExitError)
+		app.Wait()
+		return nil, fmt.Errorf("failed to load GUI TLS certificate: %w", err)
+	}
+
+	timeout := time.Duration(startup.StartupTimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultStartupTimeout
+	}
+
+	if err := waitForGUI(cfg, guiCert, timeout); err != nil {
+		cancel()
+		go app.Stop(svcutil.ExitError)
+		app.Wait()
+		return nil, &StartupError{Err: err}
+	}
+
+	appWrapper := &SyncthingApp{
+		app:      app,
+		cfg:      cfg,
+		guiCert:  guiCert,
+		receiver: startup.Receiver,
+		cancel:   cancel,
+		evLogger: evLogger,
+		streams:  map[*EventStream]struct{}{},
+	}
+
+	currentApp = appWrapper
+
+	// Release stLock before invoking the receiver so that it can safely
+	// call back into Subscribe, PostEvent, or any config mutator from
+	// inside OnSyncthingStart without self-deadlocking.
+	locked = false
+	stLock.Unlock()
+
+	startup.Receiver.OnSyncthingStart(appWrapper)
+
+	return appWrapper, nil
+}
+
+// Wait blocks until Syncthing stops, then unregisters the app as the running
+// instance (so Start may be called again) and reports the outcome.
+func (app *SyncthingApp) Wait() error {
+	status := app.app.Wait()
+
+	app.closeAllStreams()
+	_ = app.StopAudit()
+	app.cancel()
+
+	stLock.Lock()
+	currentApp = nil
+	stLock.Unlock()
+
+	app.receiver.OnSyncthingStop(app)
+
+	if status == svcutil.ExitError {
+		return fmt.Errorf("failed when stopping syncthing: %w", app.app.Error())
+	}
+
+	return nil
+}
+
+// Config archives are a zip file prefixed with one of these magic headers,
+// followed (for the encrypted variant) by a scrypt salt and AES-GCM nonce.
+// The old ImportConfiguration/ExportConfiguration wrote a bare zip with
+// neither header, which the import side still recognizes for backward
+// compatibility.
+const (
+	configArchiveMagicPlain     = "BSCA1\n"
+	configArchiveMagicEncrypted = "BSCE1\n"
+	configArchiveSchemaVersion  = 1
+
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+type manifestEntry struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+type manifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Entries       []manifestEntry `json:"entries"`
+}
+
+// ExportOptions controls what ExportConfigurationV2 includes in the archive
+// and whether it's encrypted.
+type ExportOptions struct {
+	// Passphrase, if non-empty, causes the archive to be encrypted with a
+	// scrypt-derived AES-GCM key so that it can safely contain the device
+	// key.
+	Passphrase string
+
+	IncludeDatabase bool
+
+	// IncludeTLSKeys requires Passphrase to be set: the device's private
+	// key and the GUI's TLS private key must never leave the device
+	// unencrypted.
+	IncludeTLSKeys bool
+}
+
+// ImportOptions controls how ImportConfigurationV2 reads an archive.
+type ImportOptions struct {
+	// Passphrase must match the one passed to ExportOptions if the archive
+	// is encrypted.
+	Passphrase string
+}
+
+func isDatabasePath(relPath string) bool {
+	return relPath == filepath.Base(locations.Get(locations.Database)) ||
+		strings.HasPrefix(relPath, filepath.Base(locations.Get(locations.Database))+string(os.PathSeparator))
+}
+
+func isTLSKeyPath(relPath string) bool {
+	return relPath == filepath.Base(locations.Get(locations.KeyFile)) ||
+		relPath == filepath.Base(locations.Get(locations.HTTPSKeyFile))
+}
+
+// ExportConfigurationV2 writes an integrity-verified, optionally encrypted
+// archive of the config directory to fd.
+func ExportConfigurationV2(fd int, opts *ExportOptions) error {
+	if opts == nil {
+		opts = &ExportOptions{}
+	}
+	if opts.IncludeTLSKeys && len(opts.Passphrase) == 0 {
+		return fmt.Errorf("IncludeTLSKeys requires a non-empty Passphrase")
+	}
+
+	stLock.Lock()
+	defer stLock.Unlock()
+
+	file := os.NewFile(uintptr(fd), "export")
+	if file == nil {
+		return fmt.Errorf("failed to open fd: %d", fd)
+	}
+	defer file.Close()
+
+	// The plain archive can be written directly to the fd as we build it.
+	// Only the encrypted path needs the whole thing in memory, since
+	// gcm.Seal takes the entire plaintext in one call.
+	if len(opts.Passphrase) == 0 {
+		if _, err := file.Write([]byte(configArchiveMagicPlain)); err != nil {
+			return fmt.Errorf("failed to write archive header: %w", err)
+		}
+
+		return writeConfigZip(file, opts)
+	}
+
+	var archive bytes.Buffer
+	if err := writeConfigZip(&archive, opts); err != nil {
+		return err
+	}
+
+	return encryptAndWriteArchive(file, archive.Bytes(), opts.Passphrase)
+}
+
+// writeConfigZip walks the config directory and writes a manifest-covered
+// zip archive to w.
+func writeConfigZip(w io.Writer, opts *ExportOptions) error {
+	configDir := locations.GetBaseDir(locations.ConfigBaseDir)
+
+	writer := zip.NewWriter(w)
+
+	var entries []manifestEntry
+
+	walker := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed when walking: %q: %w", configDir, err)
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(configDir, path)
+		if err != nil {
+			return fmt.Errorf("failed to compute relative path: %q: %w", path, err)
+		}
+
+		if !opts.IncludeDatabase && isDatabasePath(relPath) {
+			return nil
+		}
+		if !opts.IncludeTLSKeys && isTLSKeyPath(relPath) {
+			return nil
+		}
+
+		input, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open for reading: %q: %w", path, err)
+		}
+		defer input.Close()
+
+		relPath = filepath.ToSlash(relPath)
+
+		entry, err := writer.Create(relPath)
+		if err != nil {
+			return fmt.Errorf("failed to create file entry: %q: %w", relPath, err)
+		}
+
+		hasher := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(entry, hasher), input); err != nil {
+			return fmt.Errorf("failed to write file data: %q: %w", relPath, err)
+		}
+
+		entries = append(entries, manifestEntry{
+			Path:   relPath,
+			SHA256: hex.EncodeToString(hasher.Sum(nil)),
+		})
+
+		return nil
+	}
+
+	if err := filepath.Walk(configDir, walker); err != nil {
+		return fmt.Errorf("failed to walk: %q: %w", configDir, err)
+	}
+
+	manifestData, err := json.Marshal(manifest{
+		SchemaVersion: configArchiveSchemaVersion,
+		Entries:       entries,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	manifestWriter, err := writer.Create("MANIFEST.json")
+	if err != nil {
+		return fmt.Errorf("failed to create manifest entry: %w", err)
+	}
+	if _, err := manifestWriter.Write(manifestData); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to finalize archive: %w", err)
+	}
+
+	return nil
+}
+
+// encryptAndWriteArchive encrypts plain with a scrypt-derived AES-GCM key
+// and writes the encrypted archive header, salt, nonce and ciphertext to
+// file.
+func encryptAndWriteArchive(file *os.File, plain []byte, passphrase string) error {
+	gcm, salt, err := newArchiveCipher(passphrase, nil)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := cryptorand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	ciphertext := gcm.Seal(nil, nonce, plain, nil)
+
+	if _, err := file.Write([]byte(configArchiveMagicEncrypted)); err != nil {
+		return fmt.Errorf("failed to write archive header: %w", err)
+	}
+	if _, err := file.Write(salt); err != nil {
+		return fmt.Errorf("failed to write salt: %w", err)
+	}
+	if _, err := file.Write(nonce); err != nil {
+		return fmt.Errorf("failed to write nonce: %w", err)
+	}
+	if _, err := file.Write(ciphertext); err != nil {
+		return fmt.Errorf("failed to write archive data: %w", err)
+	}
+
+	return nil
+}
+
+// newArchiveCipher derives an AES-GCM cipher from passphrase using scrypt.
+// If salt is nil, a fresh random one is generated; otherwise the given salt
+// is reused (for decryption).
+func newArchiveCipher(passphrase string, salt []byte) (cipher.AEAD, []byte, error) {
+	if salt == nil {
+		salt = make([]byte, 16)
+		if _, err := cryptorand.Read(salt); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate salt: %w", err)
+		}
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize cipher: %w", err)
+	}
+
+	return gcm, salt, nil
+}
+
+// errNoManifest is returned by readManifest when the archive has no
+// MANIFEST.json, which callers treat as "this is a legacy bare-zip
+// archive", as opposed to a manifest that is merely corrupt or
+// unsupported, which must still be a hard failure.
+var errNoManifest = errors.New("archive is missing MANIFEST.json")
+
+// openConfigArchive sniffs the magic header on file and returns a
+// *zip.Reader over its contents, decrypting first if necessary. The plain
+// and legacy cases read directly against file's io.ReaderAt so the
+// archive never needs to be buffered in memory; only the encrypted case
+// requires reading the whole ciphertext up front, since gcm.Open needs it
+// all in one call.
+func openConfigArchive(file *os.File, passphrase string) (*zip.Reader, error) {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine archive size: %w", err)
+	}
+
+	headerLen := int64(len(configArchiveMagicPlain))
+	header := make([]byte, headerLen)
+	if size >= headerLen {
+		if _, err := file.ReadAt(header, 0); err != nil {
+			return nil, fmt.Errorf("failed to read archive header: %w", err)
+		}
+	}
+
+	switch {
+	case bytes.Equal(header, []byte(configArchiveMagicPlain)):
+		body := io.NewSectionReader(file, headerLen, size-headerLen)
+		return zip.NewReader(body, size-headerLen)
+
+	case bytes.Equal(header, []byte(configArchiveMagicEncrypted)):
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("archive is encrypted but no passphrase was supplied")
+		}
+
+		rest := make([]byte, size-headerLen)
+		if _, err := file.ReadAt(rest, headerLen); err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		if len(rest) < 16 {
+			return nil, fmt.Errorf("archive is truncated")
+		}
+		salt, rest := rest[:16], rest[16:]
+
+		gcm, _, err := newArchiveCipher(passphrase, salt)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(rest) < gcm.NonceSize() {
+			return nil, fmt.Errorf("archive is truncated")
+		}
+		nonce, ciphertext := rest[:gcm.NonceSize()], rest[gcm.NonceSize():]
+
+		plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt archive (wrong passphrase?): %w", err)
+		}
+
+		return zip.NewReader(bytes.NewReader(plain), int64(len(plain)))
+
+	default:
+		// No recognized magic: a legacy bare zip archive written by the
+		// original ExportConfiguration.
+		return zip.NewReader(file, size)
+	}
+}
+
+func readManifest(reader *zip.Reader) (*manifest, error) {
+	f, err := reader.Open("MANIFEST.json")
+	if err != nil {
+		return nil, errNoManifest
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	if m.SchemaVersion != configArchiveSchemaVersion {
+		return nil, fmt.Errorf("unsupported manifest schema version: %d", m.SchemaVersion)
+	}
+
+	return &m, nil
+}
+
+// stageAndInstall runs install against a fresh staging directory next to
+// configDir, and only replaces configDir with it once install returns
+// successfully, so a corrupt or malicious archive never leaves the user
+// with a half-extracted config directory.
+func stageAndInstall(configDir string, install func(tmpDir string) error) error {
+	tmpDir := configDir + ".import-tmp"
+
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return fmt.Errorf("failed to clear staging directory: %q: %w", tmpDir, err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := os.MkdirAll(tmpDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create staging directory: %q: %w", tmpDir, err)
+	}
+
+	if err := install(tmpDir); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(configDir); err != nil {
+		return fmt.Errorf("failed to delete: %q: %w", configDir, err)
+	}
+
+	if err := os.Rename(tmpDir, configDir); err != nil {
+		return fmt.Errorf("failed to install imported configuration: %w", err)
+	}
+
+	return nil
+}
+
+func extractEntry(f *zip.File, destPath string) error {
+	entry, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open file entry: %q: %w", f.Name, err)
+	}
+	defer entry.Close()
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0o700); err != nil {
+		return fmt.Errorf("failed to create directory: %q: %w", filepath.Dir(destPath), err)
+	}
+
+	output, err := os.OpenFile(destPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode()&0o700)
+	if err != nil {
+		return fmt.Errorf("failed to open for writing: %q: %w", destPath, err)
+	}
+	defer output.Close()
+
+	if _, err := io.Copy(output, entry); err != nil {
+		return fmt.Errorf("failed to write file data: %q: %w", destPath, err)
+	}
+
+	return nil
+}
+
+func extractVerifiedEntry(f *zip.File, destPath, wantHash string) error {
+	entry, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open file entry: %q: %w", f.Name, err)
+	}
+	defer entry.Close()
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0o700); err != nil {
+		return fmt.Errorf("failed to create directory: %q: %w", filepath.Dir(destPath), err)
+	}
+
+	output, err := os.OpenFile(destPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode()&0o700)
+	if err != nil {
+		return fmt.Errorf("failed to open for writing: %q: %w", destPath, err)
+	}
+	defer output.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(output, hasher), entry); err != nil {
+		return fmt.Errorf("failed to write file data: %q: %w", destPath, err)
+	}
+
+	if gotHash := hex.EncodeToString(hasher.Sum(nil)); gotHash != wantHash {
+		return fmt.Errorf("checksum mismatch: %q", f.Name)
+	}
+
+	return nil
+}
+
+// resolveEntryPath joins relPath under configDir and rejects it if it
+// escapes configDir, without touching the filesystem.
+func resolveEntryPath(configDir, relPath string) (string, error) {
+	destPath := filepath.Join(configDir, filepath.FromSlash(relPath))
+	if !strings.HasPrefix(destPath, configDir+string(os.PathSeparator)) {
+		return "", fmt.Errorf("unsafe entry path: %q", relPath)
+	}
+
+	return destPath, nil
+}
+
+// copyMissingFiles walks configDir and copies any regular file whose
+// slash-relative path is not a key of present into tmpDir at the same
+// relative path. This preserves files that were deliberately excluded
+// from a manifest archive (the sync database, or TLS keys, when the
+// export was made with IncludeDatabase/IncludeTLSKeys unset) instead of
+// letting stageAndInstall's directory swap silently delete them.
+func copyMissingFiles(configDir, tmpDir string, present map[string]string) error {
+	if _, err := os.Stat(configDir); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to stat: %q: %w", configDir, err)
+	}
+
+	return filepath.Walk(configDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed when walking: %q: %w", configDir, err)
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(configDir, path)
+		if err != nil {
+			return fmt.Errorf("failed to compute relative path: %q: %w", path, err)
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		if _, ok := present[relPath]; ok {
+			return nil
+		}
+
+		destPath, err := resolveEntryPath(tmpDir, relPath)
+		if err != nil {
+			return err
+		}
+
+		input, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open for reading: %q: %w", path, err)
+		}
+		defer input.Close()
+
+		if err := os.MkdirAll(filepath.Dir(destPath), 0o700); err != nil {
+			return fmt.Errorf("failed to create directory: %q: %w", filepath.Dir(destPath), err)
+		}
+
+		output, err := os.OpenFile(destPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode()&0o700)
+		if err != nil {
+			return fmt.Errorf("failed to open for writing: %q: %w", destPath, err)
+		}
+		defer output.Close()
+
+		if _, err := io.Copy(output, input); err != nil {
+			return fmt.Errorf("failed to copy preserved file: %q: %w", relPath, err)
+		}
+
+		return nil
+	})
+}
+
+// importManifestArchive installs the files in reader into configDir as
+// validated by m, preserving any existing file under configDir that the
+// manifest deliberately excludes.
+func importManifestArchive(reader *zip.Reader, configDir string, m *manifest) error {
+	// Resolve and validate every entry's path before any file is touched.
+	hashesByPath := make(map[string]string, len(m.Entries))
+	for _, entry := range m.Entries {
+		if _, err := resolveEntryPath(configDir, entry.Path); err != nil {
+			return err
+		}
+
+		hashesByPath[entry.Path] = entry.SHA256
+	}
+
+	return stageAndInstall(configDir, func(tmpDir string) error {
+		seen := make(map[string]bool, len(hashesByPath))
+
+		for _, f := range reader.File {
+			if f.FileInfo().IsDir() || f.Name == "MANIFEST.json" {
+				continue
+			}
+
+			wantHash, ok := hashesByPath[f.Name]
+			if !ok {
+				return fmt.Errorf("entry missing from manifest: %q", f.Name)
+			}
+			seen[f.Name] = true
+
+			destPath, err := resolveEntryPath(tmpDir, f.Name)
+			if err != nil {
+				return err
+			}
+
+			if err := extractVerifiedEntry(f, destPath, wantHash); err != nil {
+				return err
+			}
+		}
+
+		for path := range hashesByPath {
+			if !seen[path] {
+				return fmt.Errorf("manifest entry missing from archive: %q", path)
+			}
+		}
+
+		return copyMissingFiles(configDir, tmpDir, hashesByPath)
+	})
+}
+
+func importLegacyArchive(reader *zip.Reader, configDir string) error {
+	// Validate every entry's path before any file is touched.
+	for _, f := range reader.File {
+		if _, err := resolveEntryPath(configDir, f.Name); err != nil {
+			return err
+		}
+	}
+
+	return stageAndInstall(configDir, func(tmpDir string) error {
+		for _, f := range reader.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+
+			destPath, err := resolveEntryPath(tmpDir, f.Name)
+			if err != nil {
+				return err
+			}
+
+			if err := extractEntry(f, destPath); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// importConfigurationData opens the archive in file, verifying it against
+// its manifest if one is present, and otherwise falling back to treating
+// it as a legacy unverified archive.
+func importConfigurationData(file *os.File, passphrase string) error {
+	reader, err := openConfigArchive(file, passphrase)
+	if err != nil {
+		return err
+	}
+
+	configDir := filepath.Clean(locations.GetBaseDir(locations.ConfigBaseDir))
+
+	m, err := readManifest(reader)
+	if err != nil {
+		if errors.Is(err, errNoManifest) {
+			return importLegacyArchive(reader, configDir)
+		}
+		return err
+	}
+
+	return importManifestArchive(reader, configDir, m)
+}
+
+// ImportConfigurationV2 verifies and restores an archive written by
+// ExportConfigurationV2. It refuses to run while Syncthing is running, and
+// only replaces the config directory after the whole archive has been
+// verified against its manifest. An archive without a MANIFEST.json is
+// restored as a legacy archive, without hash verification.
+func ImportConfigurationV2(fd int, opts *ImportOptions) error {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+
+	stLock.Lock()
+	defer stLock.Unlock()
+
+	if currentApp != nil {
+		return fmt.Errorf("cannot import configuration while syncthing is running")
+	}
+
+	file := os.NewFile(uintptr(fd), "import")
+	if file == nil {
+		return fmt.Errorf("failed to open fd: %d", fd)
+	}
+	defer file.Close()
+
+	return importConfigurationData(file, opts.Passphrase)
+}
+
+// ImportConfiguration restores a configuration archive. It is kept for
+// older Android clients and transparently handles both the plain zip
+// archives written by the original ExportConfiguration and the manifest-
+// verified archives written by ExportConfigurationV2; new code should call
+// ImportConfigurationV2 directly.
+func ImportConfiguration(fd int, name string) error {
+	stLock.Lock()
+	defer stLock.Unlock()
+
+	if currentApp != nil {
+		return fmt.Errorf("cannot import configuration while syncthing is running")
+	}
+
+	file := os.NewFile(uintptr(fd), name)
+	if file == nil {
+		return fmt.Errorf("failed to open fd: %d", fd)
+	}
+	defer file.Close()
+
+	return importConfigurationData(file, "")
+}
+
+// ExportConfiguration is kept for older Android clients; it now always
+// writes the safer ExportConfigurationV2 format. New code should call
+// ExportConfigurationV2 directly to control what's included or to encrypt
+// the archive.
+func ExportConfiguration(fd int, name string) error {
+	return ExportConfigurationV2(fd, nil)
 }